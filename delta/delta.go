@@ -0,0 +1,483 @@
+// Package delta implements a small rsync/wharf-style block matching scheme
+// so a partially-received file can be finished off without retransmitting
+// blocks the receiver already has.
+//
+// The receiver splits its partial copy into fixed-size blocks and builds a
+// Signature (a fast rolling weak checksum plus a strong hash per block). The
+// sender then scans the full source with ComputeDelta, which slides a window
+// byte-by-byte, checks the weak checksum against the signature, and confirms
+// real matches with the strong hash before emitting a Copy instruction. Any
+// bytes that don't match anything become Literal instructions. ApplyDelta
+// replays those instructions against the old file to reconstruct the new one.
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultBlockSize is used when callers don't have a reason to pick their own.
+const DefaultBlockSize = 4096
+
+// BlockSignature describes one fixed-size block of the receiver's partial file.
+type BlockSignature struct {
+	Index  int64
+	Weak   uint32
+	Strong [sha256.Size]byte
+}
+
+// Signature is the full set of block signatures the receiver sends the sender
+// before a resumed transfer, along with the block size they were cut with.
+type Signature struct {
+	BlockSize int64
+	Blocks    []BlockSignature
+}
+
+// ManifestHeader is sent ahead of a delta transfer so both sides agree on
+// what they're reconstructing and can verify the result afterwards.
+type ManifestHeader struct {
+	TotalSize int64
+	BlockSize int64
+	FileHash  [sha256.Size]byte
+}
+
+// BuildSignature reads r in BlockSize-d chunks and hashes each one.
+func BuildSignature(r io.Reader, blockSize int64) (*Signature, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	var index int64
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			block := buf[:n]
+			sig.Blocks = append(sig.Blocks, BlockSignature{
+				Index:  index,
+				Weak:   weakChecksum(block),
+				Strong: sha256.Sum256(block),
+			})
+			index++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sig, nil
+}
+
+// weakChecksum computes an adler32-style rolling checksum over a block from
+// scratch. rollChecksum below updates one of these incrementally instead, and
+// is what ComputeDelta actually uses once the window is full - this version
+// stays around for BuildSignature, where every block is only ever hashed once.
+func weakChecksum(block []byte) uint32 {
+	var a, b uint32
+	for _, c := range block {
+		a += uint32(c)
+		b += a
+	}
+	return a&0xffff | b<<16
+}
+
+// rollChecksum updates a weakChecksum result for a window that has slid
+// forward by one byte: out has left the window, in has entered it, and
+// windowLen is the window's (constant) length. This is what makes
+// ComputeDelta's byte-by-byte scan O(n) instead of O(n*blockSize).
+func rollChecksum(a, b uint32, out, in byte, windowLen int64) (uint32, uint32) {
+	a = a - uint32(out) + uint32(in)
+	b = b - uint32(windowLen)*uint32(out) + a
+	return a, b
+}
+
+func splitChecksum(weak uint32) (a, b uint32) {
+	return weak & 0xffff, weak >> 16
+}
+
+func joinChecksum(a, b uint32) uint32 {
+	return a&0xffff | b<<16
+}
+
+// Op identifies what kind of instruction the sender emitted.
+type Op int
+
+const (
+	// OpCopy means "copy block Block from the receiver's old file".
+	OpCopy Op = iota
+	// OpLiteral means "here are bytes that weren't found in the old file".
+	OpLiteral
+)
+
+// Instruction is one step of the reconstruction plan ComputeDelta produces.
+type Instruction struct {
+	Op     Op
+	Block  int64
+	Data   []byte
+	Offset int64 // absolute byte offset this instruction begins at in the reconstructed file
+}
+
+// signatureIndex groups block signatures by weak checksum so ComputeDelta can
+// look up window matches in roughly constant time.
+type signatureIndex struct {
+	blockSize int64
+	byWeak    map[uint32][]BlockSignature
+}
+
+func newSignatureIndex(sig *Signature) *signatureIndex {
+	idx := &signatureIndex{
+		blockSize: sig.BlockSize,
+		byWeak:    make(map[uint32][]BlockSignature, len(sig.Blocks)),
+	}
+	for _, b := range sig.Blocks {
+		idx.byWeak[b.Weak] = append(idx.byWeak[b.Weak], b)
+	}
+	return idx
+}
+
+func (idx *signatureIndex) match(window []byte, weak uint32) (BlockSignature, bool) {
+	candidates, ok := idx.byWeak[weak]
+	if !ok {
+		return BlockSignature{}, false
+	}
+	strong := sha256.Sum256(window)
+	for _, c := range candidates {
+		if c.Strong == strong {
+			return c, true
+		}
+	}
+	return BlockSignature{}, false
+}
+
+// ComputeDelta scans src against sig using a sliding window, one byte at a
+// time, and returns the instruction stream needed to turn the receiver's old
+// file into src.
+func ComputeDelta(src io.Reader, sig *Signature) ([]Instruction, error) {
+	blockSize := sig.BlockSize
+	if blockSize <= 0 {
+		return nil, errors.New("delta: signature has an empty block size")
+	}
+	idx := newSignatureIndex(sig)
+
+	br := bufio.NewReader(src)
+	window := make([]byte, 0, blockSize)
+	var literal []byte
+	var instructions []Instruction
+	var pos int64 // how many reconstructed-file bytes precede the instruction being built
+
+	// weakA/weakB are only meaningful while full is true, i.e. while they
+	// reflect a window of exactly blockSize bytes. They're rolled forward by
+	// one byte at a time via rollChecksum instead of recomputed from scratch
+	// on every slide, which is what keeps this scan O(n) instead of
+	// O(n*blockSize).
+	var weakA, weakB uint32
+	full := false
+
+	flushLiteral := func() {
+		if len(literal) == 0 {
+			return
+		}
+		instructions = append(instructions, Instruction{Op: OpLiteral, Data: literal, Offset: pos})
+		pos += int64(len(literal))
+		literal = nil
+	}
+
+	for {
+		for int64(len(window)) < blockSize {
+			b, err := br.ReadByte()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			window = append(window, b)
+		}
+		if len(window) == 0 {
+			break
+		}
+
+		if int64(len(window)) == blockSize && !full {
+			weakA, weakB = splitChecksum(weakChecksum(window))
+			full = true
+		}
+
+		if full {
+			if block, ok := idx.match(window, joinChecksum(weakA, weakB)); ok {
+				flushLiteral()
+				instructions = append(instructions, Instruction{Op: OpCopy, Block: block.Index, Offset: pos})
+				pos += int64(len(window))
+				window = window[:0]
+				full = false
+				continue
+			}
+		}
+
+		// No match at this position: the oldest byte in the window becomes a
+		// literal byte, and we slide forward by one, rolling the checksum
+		// along with it rather than recomputing it over the new window.
+		out := window[0]
+		window = window[1:]
+		literal = append(literal, out)
+
+		if full {
+			in, err := br.ReadByte()
+			if err == io.EOF {
+				full = false
+			} else if err != nil {
+				return nil, err
+			} else {
+				weakA, weakB = rollChecksum(weakA, weakB, out, in, blockSize)
+				window = append(window, in)
+			}
+		}
+	}
+
+	flushLiteral()
+	return instructions, nil
+}
+
+// ApplyDelta reconstructs the new file into dst, pulling OpCopy blocks out of
+// old and writing OpLiteral bytes straight through.
+func ApplyDelta(old io.ReaderAt, blockSize int64, instructions []Instruction, dst io.Writer) error {
+	buf := make([]byte, blockSize)
+	for _, inst := range instructions {
+		if err := ApplyInstruction(old, blockSize, inst, dst, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyInstruction applies a single instruction, for callers that want to
+// stream instructions in (e.g. straight off a network connection) rather
+// than collecting them all up front. buf must be at least blockSize long.
+func ApplyInstruction(old io.ReaderAt, blockSize int64, inst Instruction, dst io.Writer, buf []byte) error {
+	switch inst.Op {
+	case OpCopy:
+		n, err := old.ReadAt(buf[:blockSize], inst.Block*blockSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		_, err = dst.Write(buf[:n])
+		return err
+	case OpLiteral:
+		_, err := dst.Write(inst.Data)
+		return err
+	default:
+		return errors.New("delta: unknown instruction op")
+	}
+}
+
+// ApplyInstructionHeaderAt applies a Copy instruction at its absolute
+// destination offset via WriteAt, for callers that place instructions out of
+// order - e.g. a parallel transfer where a literal span for an earlier
+// offset might still be in flight on another connection while a later copy
+// is ready to apply. Only valid for OpCopy; a literal's bytes are written
+// separately once they actually arrive.
+func ApplyInstructionHeaderAt(old io.ReaderAt, blockSize int64, hdr Instruction, dst io.WriterAt, buf []byte) error {
+	if hdr.Op != OpCopy {
+		return errors.New("delta: ApplyInstructionHeaderAt only supports OpCopy")
+	}
+	n, err := old.ReadAt(buf[:blockSize], hdr.Block*blockSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	_, err = dst.WriteAt(buf[:n], hdr.Offset)
+	return err
+}
+
+// WriteInstruction frames a single instruction as op byte, then either an
+// 8-byte block index (copies) or a length-prefixed run of raw bytes (literals).
+func WriteInstruction(w io.Writer, inst Instruction) error {
+	if _, err := w.Write([]byte{byte(inst.Op)}); err != nil {
+		return err
+	}
+
+	switch inst.Op {
+	case OpCopy:
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(inst.Block))
+		_, err := w.Write(buf)
+		return err
+	case OpLiteral:
+		lenBuf := make([]byte, 8)
+		binary.BigEndian.PutUint64(lenBuf, uint64(len(inst.Data)))
+		if _, err := w.Write(lenBuf); err != nil {
+			return err
+		}
+		_, err := w.Write(inst.Data)
+		return err
+	default:
+		return errors.New("delta: unknown instruction op")
+	}
+}
+
+// ReadInstruction reads a single instruction framed by WriteInstruction.
+// maxMessageSize caps how large a literal's payload is allowed to claim to
+// be, so a corrupted or hostile length field can't force an unbounded
+// allocation before we even know whether the rest of the frame follows.
+func ReadInstruction(r io.Reader, maxMessageSize int) (Instruction, error) {
+	opByte := make([]byte, 1)
+	if _, err := io.ReadFull(r, opByte); err != nil {
+		return Instruction{}, err
+	}
+
+	switch Op(opByte[0]) {
+	case OpCopy:
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return Instruction{}, err
+		}
+		return Instruction{Op: OpCopy, Block: int64(binary.BigEndian.Uint64(buf))}, nil
+	case OpLiteral:
+		lenBuf := make([]byte, 8)
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return Instruction{}, err
+		}
+		length := binary.BigEndian.Uint64(lenBuf)
+		if length > uint64(maxMessageSize) {
+			return Instruction{}, fmt.Errorf("delta: literal instruction claims %d bytes, more than the negotiated %d-byte max message size", length, maxMessageSize)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return Instruction{}, err
+		}
+		return Instruction{Op: OpLiteral, Data: data}, nil
+	default:
+		return Instruction{}, errors.New("delta: unknown instruction op")
+	}
+}
+
+// WriteInstructionHeader frames an instruction's metadata only, omitting a
+// literal's payload bytes; used when the payload is delivered separately
+// (e.g. across a parallel worker pool) instead of inline on this connection.
+func WriteInstructionHeader(w io.Writer, inst Instruction) error {
+	header := make([]byte, 1+8+8)
+	header[0] = byte(inst.Op)
+	binary.BigEndian.PutUint64(header[1:9], uint64(inst.Offset))
+
+	switch inst.Op {
+	case OpCopy:
+		binary.BigEndian.PutUint64(header[9:17], uint64(inst.Block))
+	case OpLiteral:
+		binary.BigEndian.PutUint64(header[9:17], uint64(len(inst.Data)))
+	default:
+		return errors.New("delta: unknown instruction op")
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+// ReadInstructionHeader reads a header framed by WriteInstructionHeader. For
+// an OpLiteral instruction, Data is left nil - the caller receives that
+// payload separately and learns its actual length from the frame it arrives
+// in (see transfer.go's literal job frames).
+func ReadInstructionHeader(r io.Reader) (Instruction, error) {
+	header := make([]byte, 1+8+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Instruction{}, err
+	}
+
+	inst := Instruction{Op: Op(header[0]), Offset: int64(binary.BigEndian.Uint64(header[1:9]))}
+	switch inst.Op {
+	case OpCopy:
+		inst.Block = int64(binary.BigEndian.Uint64(header[9:17]))
+	case OpLiteral:
+		// The length field is consumed above just to advance the stream;
+		// receiveLiteralsParallel learns each span's real length from its
+		// own frame once the bytes actually arrive.
+	default:
+		return Instruction{}, errors.New("delta: unknown instruction op")
+	}
+	return inst, nil
+}
+
+// WriteManifestHeader frames a ManifestHeader as total size, block size, then
+// the whole-file hash, so the receiver can confirm a resumed transfer
+// reconstructed the file correctly once every instruction's been applied.
+func WriteManifestHeader(w io.Writer, hdr ManifestHeader) error {
+	buf := make([]byte, 8+8+sha256.Size)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(hdr.TotalSize))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(hdr.BlockSize))
+	copy(buf[16:], hdr.FileHash[:])
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadManifestHeader reads a ManifestHeader framed by WriteManifestHeader.
+func ReadManifestHeader(r io.Reader) (ManifestHeader, error) {
+	buf := make([]byte, 8+8+sha256.Size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return ManifestHeader{}, err
+	}
+	var hdr ManifestHeader
+	hdr.TotalSize = int64(binary.BigEndian.Uint64(buf[0:8]))
+	hdr.BlockSize = int64(binary.BigEndian.Uint64(buf[8:16]))
+	copy(hdr.FileHash[:], buf[16:])
+	return hdr, nil
+}
+
+// WriteSignature frames a signature as block size, block count, then each
+// block's index, weak checksum, and strong hash.
+func WriteSignature(w io.Writer, sig *Signature) error {
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header[0:8], uint64(sig.BlockSize))
+	binary.BigEndian.PutUint64(header[8:16], uint64(len(sig.Blocks)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, b := range sig.Blocks {
+		entry := make([]byte, 8+4+sha256.Size)
+		binary.BigEndian.PutUint64(entry[0:8], uint64(b.Index))
+		binary.BigEndian.PutUint32(entry[8:12], b.Weak)
+		copy(entry[12:], b.Strong[:])
+		if _, err := w.Write(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSignature reads a signature framed by WriteSignature. maxMessageSize
+// caps how many blocks the header is allowed to claim, so a corrupted or
+// hostile block count can't force an unbounded allocation before we even
+// know whether that many entries actually follow.
+func ReadSignature(r io.Reader, maxMessageSize int) (*Signature, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	blockSize := int64(binary.BigEndian.Uint64(header[0:8]))
+	blockCount := binary.BigEndian.Uint64(header[8:16])
+
+	const entrySize = 8 + 4 + sha256.Size
+	if maxBlocks := uint64(maxMessageSize) / entrySize; blockCount > maxBlocks {
+		return nil, fmt.Errorf("delta: signature claims %d blocks, more than fit in the negotiated %d-byte max message size", blockCount, maxMessageSize)
+	}
+
+	sig := &Signature{BlockSize: blockSize, Blocks: make([]BlockSignature, blockCount)}
+	entry := make([]byte, 8+4+sha256.Size)
+	for i := range sig.Blocks {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return nil, err
+		}
+		var b BlockSignature
+		b.Index = int64(binary.BigEndian.Uint64(entry[0:8]))
+		b.Weak = binary.BigEndian.Uint32(entry[8:12])
+		copy(b.Strong[:], entry[12:])
+		sig.Blocks[i] = b
+	}
+	return sig, nil
+}
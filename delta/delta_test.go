@@ -0,0 +1,147 @@
+package delta
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestComputeDeltaAndApplyRoundTrip(t *testing.T) {
+	blockSize := int64(64)
+	old := strings.Repeat("the quick brown fox jumps over the lazy dog. ", 50)
+	old = old[:len(old)-(len(old)%int(blockSize))] // keep it an exact multiple of blockSize
+	newContent := old[:200] + "SOMETHING NEW INSERTED HERE" + old[200:]
+
+	sig, err := BuildSignature(strings.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatalf("BuildSignature: %v", err)
+	}
+
+	instructions, err := ComputeDelta(strings.NewReader(newContent), sig)
+	if err != nil {
+		t.Fatalf("ComputeDelta: %v", err)
+	}
+
+	var anyCopy bool
+	for _, inst := range instructions {
+		if inst.Op == OpCopy {
+			anyCopy = true
+			break
+		}
+	}
+	if !anyCopy {
+		t.Fatal("expected at least one OpCopy instruction given the large unchanged overlap")
+	}
+
+	var out bytes.Buffer
+	if err := ApplyDelta(bytes.NewReader([]byte(old)), sig.BlockSize, instructions, &out); err != nil {
+		t.Fatalf("ApplyDelta: %v", err)
+	}
+
+	if out.String() != newContent {
+		t.Fatalf("reconstructed file does not match: got %d bytes, want %d bytes", out.Len(), len(newContent))
+	}
+}
+
+func TestComputeDeltaIdenticalFilesIsAllCopies(t *testing.T) {
+	content := strings.Repeat("abcdefgh", 1024) // exact multiple of the block size below
+
+	sig, err := BuildSignature(strings.NewReader(content), 512)
+	if err != nil {
+		t.Fatalf("BuildSignature: %v", err)
+	}
+
+	instructions, err := ComputeDelta(strings.NewReader(content), sig)
+	if err != nil {
+		t.Fatalf("ComputeDelta: %v", err)
+	}
+
+	for _, inst := range instructions {
+		if inst.Op != OpCopy {
+			t.Fatalf("expected only OpCopy instructions for an identical file, got %v", inst.Op)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := ApplyDelta(strings.NewReader(content), sig.BlockSize, instructions, &out); err != nil {
+		t.Fatalf("ApplyDelta: %v", err)
+	}
+	if out.String() != content {
+		t.Fatal("reconstructed file does not match identical source")
+	}
+}
+
+func TestWriteReadInstructionRoundTrip(t *testing.T) {
+	cases := []Instruction{
+		{Op: OpCopy, Block: 42},
+		{Op: OpLiteral, Data: []byte("hello world")},
+		{Op: OpLiteral, Data: []byte{}},
+	}
+
+	for _, want := range cases {
+		var buf bytes.Buffer
+		if err := WriteInstruction(&buf, want); err != nil {
+			t.Fatalf("WriteInstruction: %v", err)
+		}
+		got, err := ReadInstruction(&buf, DefaultBlockSize*10)
+		if err != nil {
+			t.Fatalf("ReadInstruction: %v", err)
+		}
+		if got.Op != want.Op || got.Block != want.Block || !bytes.Equal(got.Data, want.Data) {
+			t.Fatalf("round trip mismatch: got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestReadInstructionRejectsOversizedLiteral(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteInstruction(&buf, Instruction{Op: OpLiteral, Data: make([]byte, 1024)}); err != nil {
+		t.Fatalf("WriteInstruction: %v", err)
+	}
+
+	if _, err := ReadInstruction(&buf, 100); err == nil {
+		t.Fatal("expected ReadInstruction to reject a literal bigger than maxMessageSize")
+	}
+}
+
+func TestWriteReadSignatureRoundTrip(t *testing.T) {
+	sig, err := BuildSignature(strings.NewReader(strings.Repeat("x", 10000)), 512)
+	if err != nil {
+		t.Fatalf("BuildSignature: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSignature(&buf, sig); err != nil {
+		t.Fatalf("WriteSignature: %v", err)
+	}
+
+	got, err := ReadSignature(&buf, 1<<20)
+	if err != nil {
+		t.Fatalf("ReadSignature: %v", err)
+	}
+
+	if got.BlockSize != sig.BlockSize || len(got.Blocks) != len(sig.Blocks) {
+		t.Fatalf("round trip mismatch: got %+v, want block size %d with %d blocks", got, sig.BlockSize, len(sig.Blocks))
+	}
+	for i := range sig.Blocks {
+		if got.Blocks[i] != sig.Blocks[i] {
+			t.Fatalf("block %d mismatch: got %+v, want %+v", i, got.Blocks[i], sig.Blocks[i])
+		}
+	}
+}
+
+func TestReadSignatureRejectsOversizedBlockCount(t *testing.T) {
+	sig, err := BuildSignature(strings.NewReader(strings.Repeat("x", 10000)), 512)
+	if err != nil {
+		t.Fatalf("BuildSignature: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSignature(&buf, sig); err != nil {
+		t.Fatalf("WriteSignature: %v", err)
+	}
+
+	if _, err := ReadSignature(&buf, 10); err == nil {
+		t.Fatal("expected ReadSignature to reject a block count that doesn't fit in a 10-byte max message size")
+	}
+}
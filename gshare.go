@@ -1,26 +1,54 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"flag"
 	"time"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+
+	"golang.org/x/term"
+
+	"gshare/delta"
+	"gshare/logging"
+	"gshare/pairing"
+	"gshare/securechan"
+	"gshare/session"
 )
 
-// Usage: gshare <address> [file]
+// log is gshare's logger; main() points it at the level and format the user
+// asked for via --log-level/--log-json before doing anything else.
+var log = logging.New(os.Stderr, logging.LevelInfo, false)
+
+// stderrIsTerminal decides whether the progress bar draws its interactive,
+// ANSI-escape-heavy form or just logs when a transfer finishes. It's checked
+// once at startup rather than per-write since stderr doesn't change what
+// it's connected to mid-run.
+var stderrIsTerminal = term.IsTerminal(int(os.Stderr.Fd()))
+
+// localCapabilities are the optional protocol features this build of gshare
+// understands; they're only actually used once the other side's Session
+// advertises them too.
+const localCapabilities = session.CapResume | session.CapParallel
+
+// Usage: gshare <file-or-dir>...  (to send)
+//        gshare <code>            (to receive)
 
 const (
 	PORT = "1234"
-	CHUNKSIZE = 1024
 	SECONDS_BETWEEN_CONNECTION_ATTEMPTS = 0.5
-	DEBUG_MODE = false
 	progressBarLength = 40
 	asciiProgressBar = false
+	// partialSuffix marks a file that's still being received, so an
+	// interrupted transfer leaves something behind to resume from.
+	partialSuffix = ".part"
 )
 
 func checkerr(err error) {
@@ -30,17 +58,33 @@ func checkerr(err error) {
 }
 
 func hideCursor() {
-	fmt.Print("\033[?25l")
+	if !stderrIsTerminal {
+		return
+	}
+	fmt.Fprint(os.Stderr, "\033[?25l")
 }
 
 func showCursor() {
-	fmt.Print("\033[?25h")
+	if !stderrIsTerminal {
+		return
+	}
+	fmt.Fprint(os.Stderr, "\033[?25h")
 }
 
+// UpdateProgressBar draws an interactive progress bar to stderr. When stderr
+// isn't a terminal (piped to a file, running under CI, ...) the ANSI escapes
+// would just be noise, so it steps aside and logs the outcome once instead.
 func UpdateProgressBar(completed, total int, startTime, lastUpdateTime time.Time, taskName, successMessage string) {
 	// Based on Rich (a Python library)'s progress bar
 	// The bar characters below can be found on https://www.w3.org/TR/xml-entity-names/025.html
 
+	if !stderrIsTerminal {
+		if completed == total {
+			log.Info(successMessage)
+		}
+		return
+	}
+
 	// Return if it's been less than half a second (for perfomance reasons)
 	if time.Since(lastUpdateTime) < 500 * time.Millisecond {
 		return
@@ -65,7 +109,7 @@ func UpdateProgressBar(completed, total int, startTime, lastUpdateTime time.Time
 
 	// If done
 	if completed == total {
-		fmt.Println(clearLineCode + moveCursorToStartCode + successColorCode + successMessage + resetFormattingCode)
+		fmt.Fprintln(os.Stderr, clearLineCode + moveCursorToStartCode + successColorCode + successMessage + resetFormattingCode)
 		return
 	}
 
@@ -106,7 +150,14 @@ func UpdateProgressBar(completed, total int, startTime, lastUpdateTime time.Time
 	}
 	
 	// Draw bar
-	fmt.Print(clearLineCode + moveCursorToStartCode + progressBar)
+	fmt.Fprint(os.Stderr, clearLineCode + moveCursorToStartCode + progressBar)
+}
+
+// UpdateNestedProgressBar is UpdateProgressBar with an extra "file X/Y"
+// marker folded into the task name, for transfers with more than one file.
+func UpdateNestedProgressBar(completed, total, fileIndex, fileTotal int, startTime, lastUpdateTime time.Time, taskName, successMessage string) {
+	taskName = fmt.Sprintf("%s (file %d/%d)", taskName, fileIndex, fileTotal)
+	UpdateProgressBar(completed, total, startTime, lastUpdateTime, taskName, successMessage)
 }
 
 func fileExists(path string) (bool) {
@@ -122,137 +173,269 @@ func fileExists(path string) (bool) {
 	}
 }
 
-func getIndexOfLastOccurrenceOfChar(stringToSearchThrough string, char byte) (n int, err error) {
-	for n := len(stringToSearchThrough) - 1; n >= 0; n-- {
-		if stringToSearchThrough[n] == char {
-			return n, nil
-		}
+// uniquePath returns path unchanged if nothing exists there yet, or
+// otherwise the first "stem(N).ext" variant that's free, e.g. "a.txt" ->
+// "a(2).txt". This is what keeps a fresh transfer from silently clobbering
+// an unrelated file that happens to already sit at the destination path.
+func uniquePath(path string) string {
+	if !fileExists(path) {
+		return path
 	}
 
-	return -1, errors.New("char not in string")
-}
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
 
-func InfoPrint(info ...any) {
-	fmt.Print("\033[2m") // set dim/faint mode
-	for i, word := range info {
-		fmt.Printf("%v", word)
-		if i != len(info) - 1 {
-			fmt.Print(" ")
+	for n := 2; ; n++ {
+		candidate := stem + "(" + strconv.Itoa(n) + ")" + ext
+		if !fileExists(candidate) {
+			return candidate
 		}
 	}
-	fmt.Println("\033[0m") // reset formatting
 }
 
-func InfoPrintReplaceLine(info ...any) {
-	fmt.Print("\033[2K") // clear line
-	fmt.Print("\r") // move cursor to start of line
-	fmt.Print("\033[2m") // set dim/faint mode
-	for i, word := range info {
-		fmt.Printf("%v", word)
-		if i != len(info) - 1 {
-			fmt.Print(" ")
-		}
+// localAddress returns the IP address this machine would use to reach the
+// public internet, without actually sending anything - net.Dial for UDP just
+// picks a local address and route, it never puts a packet on the wire. This
+// is folded into the pairing code so the receiver doesn't also need to be
+// told the sender's address out of band.
+func localAddress() (string, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// verifyFileHash re-reads path and confirms its whole-file SHA-256 hash
+// matches want, the integrity check the sender computed in its ManifestHeader
+// while it still had the original bytes in hand. This is the only thing that
+// catches a resumed transfer that reconstructed a subtly wrong file, since
+// every instruction can apply cleanly and still add up to the wrong result.
+func verifyFileHash(path string, want [sha256.Size]byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+
+	var got [sha256.Size]byte
+	copy(got[:], hasher.Sum(nil))
+	if got != want {
+		return errors.New("gshare: resumed file \"" + path + "\" failed its whole-file integrity check")
 	}
-	fmt.Print("\033[0m") // reset formatting
+	return nil
 }
 
-func sendFile(ipAddress, filePath string) {
+func sendFile(paths []string) {
 	// ---------- Get Socket Connection --------------------
 
 	// Listen for connections
 	ln, err := net.Listen("tcp", ":" + PORT)
-	InfoPrint("Server hosted on port", PORT)
+	log.Info("server hosted", "port", PORT)
+	checkerr(err)
+
+	// Anyone can connect; the pairing code below is what actually decides
+	// whether they get anything.
+	code := pairing.GenerateCode()
+	address, err := localAddress()
 	checkerr(err)
+	packedCode := pairing.PackCode(code, address)
+	log.Info("pairing code ready", "code", packedCode)
+	log.Info("have the receiver run \"gshare " + packedCode + "\"")
 
 	var conn net.Conn
+	var sess *session.Session
+	var secureKey []byte
 	for {
 		// Accept any incominging connections
 		conn, err = ln.Accept()
 		checkerr(err)
-		
-		
-		// Get the remote address
+
+		// Get the remote address, just for logging
 		remoteAddress, _, _ := strings.Cut(conn.RemoteAddr().String(), ":")
-		// Close the connection and redo the loop
-		if remoteAddress != ipAddress {
-			// Send a 0 to say that they've been rejected
-			responseBytes := make([]byte, 1)
-			responseBytes[0] = 0
-			conn.Write(responseBytes)
 
+		// ---------- Pairing --------------------
+		key, err := pairing.Exchange(conn, code, true)
+		if err != nil {
 			conn.Close()
-			InfoPrint("Rejected connection from", remoteAddress)
+			log.Warn("pairing failed, rejecting", "remote", remoteAddress)
+			continue
+		}
+
+		secureConn, err := securechan.New(conn, key, true)
+		checkerr(err)
+
+		// A mismatched code still produces a key here - SPAKE2 doesn't know
+		// any better - but it'll be a different key than the receiver
+		// derived, so the handshake below will fail to decrypt and we'll
+		// reject the connection then instead.
+		sess, err = session.NewSession(secureConn, session.RoleSender, localCapabilities)
+		if err != nil {
+			secureConn.Close()
+			log.Warn("pairing failed, rejecting", "remote", remoteAddress)
 			continue
 		}
+		conn = secureConn
+		secureKey = secureConn.Key()
 
 		// Close the connection when done
 		defer conn.Close()
 
-		// Send a 1 to say that they've been accepted
-		responseBytes := make([]byte, 1)
-		responseBytes[0] = 1
-		conn.Write(responseBytes)
-
 		// Break out of the loop
-		InfoPrint("Connection established with", remoteAddress)
+		log.Info("connection established", "remote", remoteAddress)
 		break
 	}
-	// Open file for reading
-	file, err := os.Open(filePath)
+
+	// ---------- Build and Send Manifest --------------------
+	entries, err := buildManifest(paths)
+	checkerr(err)
+
+	manifestEntries := make([]ManifestEntry, len(entries))
+	for i, entry := range entries {
+		manifestEntries[i] = entry.ManifestEntry
+	}
+	checkerr(writeManifest(conn, manifestEntries))
+	log.Info("manifest sent", "entries", len(entries))
+
+	// ---------- Send File Bodies --------------------
+	fileTotal := 0
+	for _, entry := range entries {
+		if !entry.IsDir && entry.SymlinkTarget == "" {
+			fileTotal++
+		}
+	}
+
+	fileIndex := 0
+	for _, entry := range entries {
+		if entry.IsDir || entry.SymlinkTarget != "" {
+			continue
+		}
+		fileIndex++
+		sendFileBody(conn, ln, secureKey, sess, entry, fileIndex, fileTotal)
+	}
+}
+
+// sendFileBody sends one regular file's body: a chunk count, an optional
+// resumed delta, a parallel worker-pool transfer, or the raw chunks
+// themselves over the control connection, in roughly that order of
+// preference.
+func sendFileBody(conn net.Conn, ln net.Listener, secureKey []byte, sess *session.Session, entry sourceEntry, fileIndex, fileTotal int) {
+	file, err := os.Open(entry.SourcePath)
 	checkerr(err)
-	// Close it when done
 	defer file.Close()
 
-	// ---------- Send Filename --------------------
-	// Send the filename
-	filename := file.Name() // the .name method (idc if it's technically a function it's a method) returns just the filename without the full path
-	filenameBytes := []byte(filename)
-	if DEBUG_MODE {
-		InfoPrint("filename:", filename)
-		InfoPrint("filename bytes:", filenameBytes)
-		InfoPrint("filename bytes length:", len(filenameBytes))
-	}
-	conn.Write(filenameBytes)
-	InfoPrint("Filename sent")
-
-
-	// ---------- Send Permissions --------------------
-	// Get permissions
-	info, _ := os.Stat(filePath)
-	perm := uint32(info.Mode())
-	permBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(permBytes, perm)
-	if DEBUG_MODE {
-		InfoPrint("perm:", perm)
-		InfoPrint("perm bytes:", permBytes)
-	}
-	conn.Write(permBytes)
-	InfoPrint("Permissions sent")
-
-	// ---------- Send Chunk Count --------------------
-	chunkCount := (info.Size() + CHUNKSIZE - 1) / CHUNKSIZE // Divide by chunksize, round up
+	chunkSize := int64(sess.ChunkSize)
+	chunkCount := (entry.Size + chunkSize - 1) / chunkSize // Divide by chunksize, round up
 	chunkCountBytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(chunkCountBytes, uint64(chunkCount))
-	if DEBUG_MODE {
-		InfoPrint("chunk-count:", chunkCount)
-		InfoPrint("chunk-count bytes:", chunkCountBytes)
-	}
 	conn.Write(chunkCountBytes)
-	InfoPrint("Chunk count sent")
-	
-	// ---------- Send File in Chunks --------------------
 
+	// ---------- Resume Negotiation --------------------
+	// The receiver tells us whether it already has a partial copy of this
+	// file. If it does, we switch to sending a delta instead of the whole
+	// thing. Only bother asking if both sides actually negotiated resume
+	// support.
+	resumeFlagBuffer := make([]byte, 1)
+	if sess.Supports(session.CapResume) {
+		_, err = io.ReadFull(conn, resumeFlagBuffer)
+		checkerr(err)
+	}
+
+	if resumeFlagBuffer[0] == 1 {
+		sig, err := delta.ReadSignature(conn, sess.MaxMessageSize)
+		checkerr(err)
+
+		// Hashing the file as ComputeDelta reads it, rather than in a separate
+		// pass, is what lets the receiver verify the whole reconstructed file
+		// afterwards without us reading it twice.
+		hasher := sha256.New()
+		instructions, err := delta.ComputeDelta(io.TeeReader(file, hasher), sig)
+		checkerr(err)
+
+		header := delta.ManifestHeader{TotalSize: entry.Size, BlockSize: sig.BlockSize}
+		copy(header.FileHash[:], hasher.Sum(nil))
+		checkerr(delta.WriteManifestHeader(conn, header))
+
+		instCountBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(instCountBytes, uint64(len(instructions)))
+		conn.Write(instCountBytes)
+
+		// Only worth spreading the missing (literal) spans across a worker
+		// pool if there are more of them than workers, to outweigh the
+		// dialing cost; the
+		// matched (copy) instructions never leave the control connection
+		// either way, since they don't carry any bytes to send.
+		jobs := literalJobs(instructions)
+		useParallel := sess.Supports(session.CapParallel) && len(jobs) > sess.ParallelWorkers
+		parallelFlagBuffer := []byte{0}
+		if useParallel {
+			parallelFlagBuffer[0] = 1
+		}
+		_, err = conn.Write(parallelFlagBuffer)
+		checkerr(err)
+
+		startTime := time.Now()
+		timeOfLastProgressBarUpdate := time.Unix(0, 0)
+		hideCursor()
+		UpdateNestedProgressBar(0, len(instructions), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, "Sending", "\"" + entry.Path + "\"" + " sent!")
+		for i, inst := range instructions {
+			if useParallel {
+				checkerr(delta.WriteInstructionHeader(conn, inst))
+			} else {
+				checkerr(delta.WriteInstruction(conn, inst))
+			}
+			UpdateNestedProgressBar(i + 1, len(instructions), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, "Sending", "\"" + entry.Path + "\"" + " sent!")
+		}
+		showCursor()
+
+		if useParallel && len(jobs) > 0 {
+			transferID := uint64(fileIndex)
+			workers, err := acceptWorkers(ln, secureKey, transferID, sess.ParallelWorkers)
+			checkerr(err)
+			defer closeAll(workers)
+			checkerr(sendLiteralsParallel(workers, file, jobs, fileIndex, fileTotal, "Sending", "\"" + entry.Path + "\"" + " sent!"))
+		}
+		return
+	}
+
+	// ---------- Parallel Transfer Negotiation --------------------
+	// Only worth opening extra connections for a file with enough chunks to
+	// actually spread across them; a one-chunk file would just pay the
+	// dialing cost for nothing.
+	useParallel := sess.Supports(session.CapParallel) && chunkCount > int64(sess.ParallelWorkers)
+	parallelFlagBuffer := []byte{0}
+	if useParallel {
+		parallelFlagBuffer[0] = 1
+	}
+	_, err = conn.Write(parallelFlagBuffer)
+	checkerr(err)
+
+	if useParallel {
+		transferID := uint64(fileIndex)
+		workers, err := acceptWorkers(ln, secureKey, transferID, sess.ParallelWorkers)
+		checkerr(err)
+		defer closeAll(workers)
+		checkerr(sendChunksParallel(workers, file, chunkSize, chunkCount, fileIndex, fileTotal, "Sending", "\""+entry.Path+"\""+" sent!"))
+		return
+	}
+
+	// ---------- Send File in Chunks --------------------
 
 	// Create read buffer
-	readBuffer := make([]byte, CHUNKSIZE)
+	readBuffer := make([]byte, chunkSize)
 	// Create reader
 	reader := io.Reader(file)
 
-
 	startTime := time.Now()
 	timeOfLastProgressBarUpdate := time.Unix(0, 0) // The progress bar was last updated in 1970, because why not
 	hideCursor()
-	UpdateProgressBar(0, int(chunkCount), startTime, timeOfLastProgressBarUpdate, "Sending", "\"" + filename + "\"" + " sent!")
+	UpdateNestedProgressBar(0, int(chunkCount), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, "Sending", "\"" + entry.Path + "\"" + " sent!")
 
 	for chunksSentCount := int64(0); chunksSentCount < chunkCount; chunksSentCount++ {
 		// Read next chunk
@@ -260,32 +443,32 @@ func sendFile(ipAddress, filePath string) {
 		checkerr(err)
 		// Send chunk
 		conn.Write(readBuffer[:n])
-		UpdateProgressBar(int(chunksSentCount) + 1, int(chunkCount), startTime, timeOfLastProgressBarUpdate, "Sending", "\"" + filename + "\"" + " sent!")
+		UpdateNestedProgressBar(int(chunksSentCount) + 1, int(chunkCount), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, "Sending", "\"" + entry.Path + "\"" + " sent!")
 	}
 	showCursor()
 }
 
-func receiveFile(ipAddress string) {
+func receiveFile(packedCode string) {
+	// ---------- Unpack the Code --------------------
+	code, address, err := pairing.ParseCode(packedCode)
+	checkerr(err)
+
 	// ---------- Get Socket Connection --------------------
-	InfoPrint("Trying to connect")
+	log.Info("trying to connect")
 
 	var conn net.Conn
-	var err error
 
 	// Keep trying to connect
 	attemptNumber := 0
 	for {
 		attemptNumber++
 
-		conn, err = net.Dial("tcp", ipAddress + ":" + PORT)
+		conn, err = net.Dial("tcp", address + ":" + PORT)
 
-		if DEBUG_MODE {
-			if err == nil {
-				InfoPrintReplaceLine("Connected after", attemptNumber, "attempts")
-				fmt.Println() // the replace-line variation omits the newline, so print one back in
-			} else {
-				InfoPrintReplaceLine("Attempt", attemptNumber, "error:", "\"" + err.Error() + "\"")
-			}
+		if err == nil {
+			log.Debug("connected", "attempts", attemptNumber)
+		} else {
+			log.Debug("connection attempt failed", "attempt", attemptNumber, "error", err)
 		}
 
 		// If everything worked out continue with the rest of the program
@@ -297,120 +480,292 @@ func receiveFile(ipAddress string) {
 	// Close the connection when done
 	defer conn.Close()
 
-	// Checker whether accepted or rejected
-	acceptedOrRejectedBuffer := make([]byte, 1) // The name sounds bad but I can't think of a better one
-	_, err = conn.Read(acceptedOrRejectedBuffer)
+	// ---------- Pairing --------------------
+	key, err := pairing.Exchange(conn, code, false)
 	checkerr(err)
-	acceptedOrRejected := int(acceptedOrRejectedBuffer[0])
-	if DEBUG_MODE {
-		InfoPrint("accepted/rejected:", acceptedOrRejected)
-		InfoPrint("accepted/rejected byte:", acceptedOrRejectedBuffer)
-	}
-	if acceptedOrRejected == 0 {
-		InfoPrint("Connection rejected, perhaps your address was mistyped on the other end?")
-		return
-	} else if acceptedOrRejected == 1 {
-		InfoPrint("Connection accepted!")
-	} else {
-		InfoPrint("accepted/rejected value was not a 0/1. This program is confused and will now exit")
+
+	secureConn, err := securechan.New(conn, key, false)
+	checkerr(err)
+	conn = secureConn
+	secureKey := secureConn.Key()
+
+	// ---------- Handshake --------------------
+	// If the code didn't match what the sender typed in, we derived a
+	// different key than they did, and this will fail to decrypt rather
+	// than produce a readable handshake.
+	sess, err := session.NewSession(conn, session.RoleReceiver, localCapabilities)
+	if err != nil {
+		log.Warn("handshake failed, perhaps the pairing code was mistyped")
 		return
 	}
 
+	// ---------- Receive and Apply Manifest --------------------
+	entries, err := readManifest(conn)
+	checkerr(err)
+	log.Info("receiving manifest", "entries", len(entries))
 
+	destRoot := "."
+	checkerr(receiveManifest(destRoot, entries))
 
-	// Get filename
-	filenameBuffer := make([]byte, 1024)
-	n, err := conn.Read(filenameBuffer)
-	checkerr(err)
-	filename := strings.TrimSpace(string(filenameBuffer[:n]))
-	if DEBUG_MODE {
-		InfoPrint("received filename:", filename)
-		InfoPrint("received filename bytes:", filenameBuffer[:n])
-		InfoPrint("received filename bytes length:", n)
+	// ---------- Receive File Bodies --------------------
+	fileTotal := 0
+	for _, entry := range entries {
+		if !entry.IsDir && entry.SymlinkTarget == "" {
+			fileTotal++
+		}
 	}
 
-	InfoPrint("Receiving \"" + filename + "\"")
-
+	fileIndex := 0
+	for _, entry := range entries {
+		if entry.IsDir || entry.SymlinkTarget != "" {
+			continue
+		}
+		fileIndex++
+		checkerr(receiveFileBody(conn, address, secureKey, sess, destRoot, entry, fileIndex, fileTotal))
+	}
+}
 
-	// Get permissions
-	permBuffer := make([]byte, 4)
-	conn.Read(permBuffer)
-	perm := os.FileMode(binary.BigEndian.Uint32(permBuffer))
-	if DEBUG_MODE {
-		InfoPrint("received perm:", perm)
-		InfoPrint("received perm bytes:", permBuffer)
+// receiveFileBody receives one regular file's body: a chunk count, then
+// either a resumed delta, a parallel worker-pool transfer, or the raw chunks
+// themselves.
+func receiveFileBody(conn net.Conn, address string, secureKey []byte, sess *session.Session, destRoot string, entry ManifestEntry, fileIndex, fileTotal int) error {
+	fullPath, err := sanitizeEntryPath(destRoot, entry.Path)
+	if err != nil {
+		return err
 	}
 
-	// Get chunk count
 	chunkCountBuffer := make([]byte, 8)
-	conn.Read(chunkCountBuffer)
+	if _, err := io.ReadFull(conn, chunkCountBuffer); err != nil {
+		return err
+	}
 	chunkCount := int64(binary.BigEndian.Uint64(chunkCountBuffer))
-	if DEBUG_MODE {
-		InfoPrint("received chunk-count:", chunkCount)
-		InfoPrint("received chunk-count bytes:", chunkCountBuffer)
+	chunkSize := int64(sess.ChunkSize)
+
+	// ---------- Resume Negotiation --------------------
+	// If we've already got a partial copy of this file sitting around from a
+	// previous attempt, tell the sender so it can send us a delta instead of
+	// starting over from scratch.
+	partialFilename := fullPath + partialSuffix
+	hasPartial := sess.Supports(session.CapResume) && fileExists(partialFilename)
+
+	if sess.Supports(session.CapResume) {
+		resumeFlagBytes := make([]byte, 1)
+		if hasPartial {
+			resumeFlagBytes[0] = 1
+		}
+		if _, err := conn.Write(resumeFlagBytes); err != nil {
+			return err
+		}
 	}
 
+	if hasPartial {
+		log.Info("found partial file, resuming", "path", entry.Path)
 
-	// ---------- Get unique filename --------------------
-	// Example:
-	// a.txt -> a(2).txt
-	newFilename := filename
-	if fileExists(filename) {
-		extensionSeperatorDotIndex, err := getIndexOfLastOccurrenceOfChar(filename, '.')
-		var stem, extension string
-		if err == nil {
-			stem = filename[:extensionSeperatorDotIndex]
-			extension = filename[extensionSeperatorDotIndex:]
-		} else if err.Error() == "char not in string" {
-			stem = filename
-			extension = ""
-		} else {
-			checkerr(err)
+		oldPartial, err := os.Open(partialFilename)
+		if err != nil {
+			return err
+		}
+
+		sig, err := delta.BuildSignature(oldPartial, delta.DefaultBlockSize)
+		if err != nil {
+			return err
+		}
+		if err := delta.WriteSignature(conn, sig); err != nil {
+			return err
+		}
+
+		header, err := delta.ReadManifestHeader(conn)
+		if err != nil {
+			return err
+		}
+		if header.TotalSize != entry.Size {
+			return errors.New("gshare: sender's manifest header disagrees with the entry size for \"" + entry.Path + "\"")
+		}
+
+		instCountBuffer := make([]byte, 8)
+		if _, err := io.ReadFull(conn, instCountBuffer); err != nil {
+			return err
+		}
+		instCount := binary.BigEndian.Uint64(instCountBuffer)
+
+		resumingFilename := partialFilename + ".resuming"
+		f, err := os.OpenFile(resumingFilename, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, entry.Mode)
+		if err != nil {
+			return err
+		}
+
+		// ---------- Parallel Transfer Negotiation --------------------
+		// If the sender decided the missing (literal) data is worth spreading
+		// across a worker pool, it still sends every instruction's metadata
+		// over this connection - only the literal bytes themselves move to
+		// the workers - so we always read the flag, and switch how we read
+		// instructions based on it.
+		parallelFlagBuffer := make([]byte, 1)
+		if _, err := io.ReadFull(conn, parallelFlagBuffer); err != nil {
+			return err
+		}
+		useParallel := parallelFlagBuffer[0] == 1
+
+		if useParallel {
+			if err := f.Truncate(entry.Size); err != nil {
+				return err
+			}
+		}
+
+		applyBuffer := make([]byte, delta.DefaultBlockSize)
+		var literalTotal int64
+		startTime := time.Now()
+		timeOfLastProgressBarUpdate := time.Unix(0, 0)
+		hideCursor()
+		UpdateNestedProgressBar(0, int(instCount), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, "Receiving", "\"" + entry.Path + "\"" + " received!")
+		for i := uint64(0); i < instCount; i++ {
+			if useParallel {
+				hdr, err := delta.ReadInstructionHeader(conn)
+				if err != nil {
+					return err
+				}
+				if hdr.Op == delta.OpCopy {
+					if err := delta.ApplyInstructionHeaderAt(oldPartial, delta.DefaultBlockSize, hdr, f, applyBuffer); err != nil {
+						return err
+					}
+				} else {
+					literalTotal++
+				}
+			} else {
+				inst, err := delta.ReadInstruction(conn, sess.MaxMessageSize)
+				if err != nil {
+					return err
+				}
+				if err := delta.ApplyInstruction(oldPartial, delta.DefaultBlockSize, inst, f, applyBuffer); err != nil {
+					return err
+				}
+			}
+			UpdateNestedProgressBar(int(i) + 1, int(instCount), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, "Receiving", "\"" + entry.Path + "\"" + " received!")
 		}
+		showCursor()
+
+		if useParallel && literalTotal > 0 {
+			transferID := uint64(fileIndex)
+			workers, err := dialWorkers(address, secureKey, transferID, sess.ParallelWorkers)
+			if err != nil {
+				return err
+			}
+			defer closeAll(workers)
 
-		filenameNumber := 1
-		for {
-			newFilename = stem + "(" + strconv.Itoa(filenameNumber) + ")" + extension
-			if !fileExists(newFilename) {
-				break
+			if err := receiveLiteralsParallel(workers, f, literalTotal, uint32(sess.MaxMessageSize), fileIndex, fileTotal, "Receiving", "\"" + entry.Path + "\"" + " received!"); err != nil {
+				return err
 			}
-			filenameNumber++
 		}
+
+		oldPartial.Close()
+		f.Close()
+
+		if err := verifyFileHash(resumingFilename, header.FileHash); err != nil {
+			return err
+		}
+
+		os.Remove(partialFilename)
+		return os.Rename(resumingFilename, fullPath)
 	}
 
-	f, err := os.OpenFile(newFilename, os.O_WRONLY | os.O_CREATE | os.O_EXCL, perm)
-	checkerr(err)
+	// ---------- Parallel Transfer Negotiation --------------------
+	parallelFlagBuffer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, parallelFlagBuffer); err != nil {
+		return err
+	}
+
+	// This is a fresh (non-resumed) transfer, so if something already sits at
+	// fullPath it isn't ours to resume into - give the new file its own,
+	// non-colliding name instead of silently overwriting it.
+	finalPath := uniquePath(fullPath)
+	if finalPath != fullPath {
+		partialFilename = finalPath + partialSuffix
+	}
+
+	f, err := os.OpenFile(partialFilename, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, entry.Mode)
+	if err != nil {
+		return err
+	}
+
+	if parallelFlagBuffer[0] == 1 {
+		transferID := uint64(fileIndex)
+		workers, err := dialWorkers(address, secureKey, transferID, sess.ParallelWorkers)
+		if err != nil {
+			return err
+		}
+		defer closeAll(workers)
 
-	dataBuffer := make([]byte, CHUNKSIZE)
+		if err := receiveChunksParallel(workers, f, chunkSize, chunkCount, fileIndex, fileTotal, "Receiving", "\""+entry.Path+"\""+" received!"); err != nil {
+			return err
+		}
 
+		f.Close()
+		return os.Rename(partialFilename, finalPath)
+	}
+
+	dataBuffer := make([]byte, chunkSize)
 
 	startTime := time.Now()
 	timeOfLastProgressBarUpdate := time.Unix(0, 0) // The progress bar was last updated in 1970, because why not
 	hideCursor()
-	UpdateProgressBar(0, int(chunkCount), startTime, timeOfLastProgressBarUpdate, "Receiving", "\"" + filename + "\"" + " received!")
+	UpdateNestedProgressBar(0, int(chunkCount), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, "Receiving", "\"" + entry.Path + "\"" + " received!")
 
 	for chunksReceived := int64(0); chunksReceived < chunkCount; chunksReceived++ {
 		n, err := conn.Read(dataBuffer)
-		checkerr(err)
+		if err != nil {
+			return err
+		}
 		f.Write(dataBuffer[:n])
-		UpdateProgressBar(int(chunksReceived) + 1, int(chunkCount), startTime, timeOfLastProgressBarUpdate, "Receiving", "\"" + filename + "\"" + " received!")
+		UpdateNestedProgressBar(int(chunksReceived) + 1, int(chunkCount), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, "Receiving", "\"" + entry.Path + "\"" + " received!")
 	}
 	showCursor()
+
+	f.Close()
+	return os.Rename(partialFilename, finalPath)
 }
 
 
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: gshare [flags] <file-or-dir>...   (to send)")
+	fmt.Fprintln(os.Stderr, "       gshare [flags] <code>             (to receive; printed by the sender)")
+	flag.PrintDefaults()
+}
+
 func main() {
-	args := os.Args[1:]
-	var mode string
-	if len(args) == 2 {
-		mode = "send"
-	} else {
-		mode = "receive"
+	logLevelFlag := flag.String("log-level", "info", "minimum log level: debug, info, warn, or error")
+	logJSONFlag := flag.Bool("log-json", false, "emit structured JSON log lines instead of plain text")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	logLevel, err := logging.ParseLevel(*logLevelFlag)
+	checkerr(err)
+	log.SetLevel(logLevel)
+	log.SetJSON(*logJSONFlag)
+
+	args := flag.Args()
+
+	// There's no flag telling us which mode to run in, so we guess from the
+	// shape of the arguments: paths that exist on disk mean "send these",
+	// a single argument that doesn't is treated as a pairing code to
+	// receive with.
+	if len(args) == 0 {
+		printUsage()
+		return
 	}
 
-	if mode == "send" {
-		sendFile(args[0], args[1])
-	} else {
+	allExist := true
+	for _, arg := range args {
+		if !fileExists(arg) {
+			allExist = false
+			break
+		}
+	}
+
+	if allExist {
+		sendFile(args)
+	} else if len(args) == 1 {
 		receiveFile(args[0])
+	} else {
+		printUsage()
 	}
 }
\ No newline at end of file
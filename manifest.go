@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ManifestEntry describes one file, directory, or symlink being sent as part
+// of a (possibly multi-file) transfer. Path is always relative to whichever
+// root it was sent from, and uses forward slashes on the wire regardless of
+// the sender's OS.
+type ManifestEntry struct {
+	Path          string
+	Mode          os.FileMode
+	Size          int64
+	ModTime       time.Time
+	IsDir         bool
+	SymlinkTarget string // only set when this entry is a symlink
+}
+
+// sourceEntry pairs a ManifestEntry with where to actually read its bytes
+// from on the sender's disk. SourcePath never goes over the wire.
+type sourceEntry struct {
+	ManifestEntry
+	SourcePath string
+}
+
+// buildManifest walks each of paths (a file or a directory) and returns one
+// sourceEntry per file, directory, and symlink found underneath it.
+func buildManifest(paths []string) ([]sourceEntry, error) {
+	var entries []sourceEntry
+
+	for _, root := range paths {
+		rootInfo, err := os.Lstat(root)
+		if err != nil {
+			return nil, err
+		}
+
+		base := filepath.Base(root)
+		if !rootInfo.IsDir() {
+			entries = append(entries, sourceEntry{
+				ManifestEntry: ManifestEntry{
+					Path:    base,
+					Mode:    rootInfo.Mode(),
+					Size:    rootInfo.Size(),
+					ModTime: rootInfo.ModTime(),
+				},
+				SourcePath: root,
+			})
+			continue
+		}
+
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			entryPath := base
+			if rel != "." {
+				entryPath = filepath.ToSlash(filepath.Join(base, rel))
+			}
+
+			entry := sourceEntry{
+				ManifestEntry: ManifestEntry{
+					Path:    entryPath,
+					Mode:    info.Mode(),
+					ModTime: info.ModTime(),
+				},
+				SourcePath: path,
+			}
+
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				entry.SymlinkTarget = target
+			case info.IsDir():
+				entry.IsDir = true
+			default:
+				entry.Size = info.Size()
+			}
+
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// sanitizeEntryPath turns entry.Path into a path under destRoot, rejecting
+// anything that could escape it: absolute paths, ".." components, or a
+// cleaned path that still resolves outside destRoot. It also resolves any
+// symlinks already present among the path's parent directories, so an
+// earlier manifest entry can't plant a symlink that makes a later,
+// lexically-safe entry write outside destRoot.
+func sanitizeEntryPath(destRoot, entryPath string) (string, error) {
+	if filepath.IsAbs(entryPath) {
+		return "", errors.New("manifest: refusing absolute path \"" + entryPath + "\"")
+	}
+
+	cleaned := filepath.Clean(filepath.FromSlash(entryPath))
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", errors.New("manifest: refusing path that escapes the destination: \"" + entryPath + "\"")
+	}
+
+	destRootAbs, err := filepath.Abs(destRoot)
+	if err != nil {
+		return "", err
+	}
+	fullAbs, err := filepath.Abs(filepath.Join(destRootAbs, cleaned))
+	if err != nil {
+		return "", err
+	}
+	if fullAbs != destRootAbs && !strings.HasPrefix(fullAbs, destRootAbs+string(filepath.Separator)) {
+		return "", errors.New("manifest: refusing path that escapes the destination: \"" + entryPath + "\"")
+	}
+
+	if err := ensureParentsNotSymlinks(destRootAbs, fullAbs); err != nil {
+		return "", err
+	}
+
+	return fullAbs, nil
+}
+
+// ensureParentsNotSymlinks walks from destRoot down to the parent directory
+// of full, rejecting the path if any component in between is a symlink. A
+// manifest entry that plants a symlink (e.g. "evil" -> "/etc") followed by a
+// lexically-safe entry underneath it (e.g. "evil/passwd") would otherwise let
+// the second entry's write follow the symlink out of destRoot.
+func ensureParentsNotSymlinks(destRootAbs, full string) error {
+	rel, err := filepath.Rel(destRootAbs, filepath.Dir(full))
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	walked := destRootAbs
+	for _, part := range parts {
+		walked = filepath.Join(walked, part)
+		info, err := os.Lstat(walked)
+		if os.IsNotExist(err) {
+			return nil // not created yet; nothing to have been tricked by
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("manifest: refusing path with a symlink in its parent directories: \"" + full + "\"")
+		}
+	}
+	return nil
+}
+
+// sanitizeSymlinkTarget rejects a symlink target that would resolve outside
+// destRoot once placed at fullPath. Relative targets are resolved against
+// the symlink's own directory, matching how the OS would follow them.
+func sanitizeSymlinkTarget(destRootAbs, fullPath, target string) error {
+	if target == "" {
+		return errors.New("manifest: refusing empty symlink target")
+	}
+
+	resolvedTarget := target
+	if !filepath.IsAbs(resolvedTarget) {
+		resolvedTarget = filepath.Join(filepath.Dir(fullPath), filepath.FromSlash(resolvedTarget))
+	}
+	resolvedTarget, err := filepath.Abs(resolvedTarget)
+	if err != nil {
+		return err
+	}
+
+	if resolvedTarget != destRootAbs && !strings.HasPrefix(resolvedTarget, destRootAbs+string(filepath.Separator)) {
+		return errors.New("manifest: refusing symlink target that escapes the destination: \"" + target + "\"")
+	}
+	return nil
+}
+
+// receiveManifest creates the directory tree and symlinks described by
+// entries under destRoot. Regular files are left for receiveFileBody to
+// create once their bytes actually arrive.
+func receiveManifest(destRoot string, entries []ManifestEntry) error {
+	destRootAbs, err := filepath.Abs(destRoot)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fullPath, err := sanitizeEntryPath(destRoot, entry.Path)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir:
+			if err := os.MkdirAll(fullPath, 0755); err != nil {
+				return err
+			}
+		case entry.SymlinkTarget != "":
+			if err := sanitizeSymlinkTarget(destRootAbs, fullPath, entry.SymlinkTarget); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+				return err
+			}
+			os.Remove(fullPath) // clear out a stale symlink from a previous attempt, if any
+			if err := os.Symlink(entry.SymlinkTarget, fullPath); err != nil {
+				return err
+			}
+		default:
+			if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeManifest sends the entry count followed by each entry, length-framed.
+func writeManifest(w io.Writer, entries []ManifestEntry) error {
+	countBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(countBytes, uint64(len(entries)))
+	if _, err := w.Write(countBytes); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := writeManifestEntry(w, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeManifestEntry(w io.Writer, entry ManifestEntry) error {
+	if err := writeString(w, entry.Path); err != nil {
+		return err
+	}
+
+	fixed := make([]byte, 4+8+8+1)
+	binary.BigEndian.PutUint32(fixed[0:4], uint32(entry.Mode))
+	binary.BigEndian.PutUint64(fixed[4:12], uint64(entry.Size))
+	binary.BigEndian.PutUint64(fixed[12:20], uint64(entry.ModTime.Unix()))
+	if entry.IsDir {
+		fixed[20] = 1
+	}
+	if _, err := w.Write(fixed); err != nil {
+		return err
+	}
+
+	return writeString(w, entry.SymlinkTarget)
+}
+
+// readManifest reads what writeManifest sent.
+func readManifest(r io.Reader) ([]ManifestEntry, error) {
+	countBytes := make([]byte, 8)
+	if _, err := io.ReadFull(r, countBytes); err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint64(countBytes)
+
+	entries := make([]ManifestEntry, count)
+	for i := range entries {
+		entry, err := readManifestEntry(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+func readManifestEntry(r io.Reader) (ManifestEntry, error) {
+	path, err := readString(r)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	fixed := make([]byte, 4+8+8+1)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return ManifestEntry{}, err
+	}
+
+	symlinkTarget, err := readString(r)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	return ManifestEntry{
+		Path:          path,
+		Mode:          os.FileMode(binary.BigEndian.Uint32(fixed[0:4])),
+		Size:          int64(binary.BigEndian.Uint64(fixed[4:12])),
+		ModTime:       time.Unix(int64(binary.BigEndian.Uint64(fixed[12:20])), 0),
+		IsDir:         fixed[20] == 1,
+		SymlinkTarget: symlinkTarget,
+	}, nil
+}
+
+func writeString(w io.Writer, s string) error {
+	lengthBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthBytes, uint32(len(s)))
+	if _, err := w.Write(lengthBytes); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(s))
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBytes); err != nil {
+		return "", err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(lengthBytes))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSanitizeEntryPathRejectsEscapes(t *testing.T) {
+	destRoot := t.TempDir()
+
+	cases := []string{
+		"/etc/passwd",
+		"../outside",
+		"a/../../outside",
+		"a/../..",
+	}
+	for _, entryPath := range cases {
+		if _, err := sanitizeEntryPath(destRoot, entryPath); err == nil {
+			t.Errorf("sanitizeEntryPath(%q): expected an error, got nil", entryPath)
+		}
+	}
+}
+
+func TestSanitizeEntryPathAllowsWellBehavedPaths(t *testing.T) {
+	destRoot := t.TempDir()
+
+	cases := []string{"a.txt", "a/b.txt", "a/b/c.txt"}
+	for _, entryPath := range cases {
+		full, err := sanitizeEntryPath(destRoot, entryPath)
+		if err != nil {
+			t.Errorf("sanitizeEntryPath(%q): unexpected error: %v", entryPath, err)
+			continue
+		}
+		destRootAbs, _ := filepath.Abs(destRoot)
+		wantPrefix := destRootAbs + string(filepath.Separator)
+		if full != destRootAbs && len(full) <= len(wantPrefix) {
+			t.Errorf("sanitizeEntryPath(%q) = %q, expected it under %q", entryPath, full, destRootAbs)
+		}
+	}
+}
+
+// TestSanitizeEntryPathRejectsPlantedSymlink covers the attack
+// ensureParentsNotSymlinks exists for: one manifest entry plants a symlink
+// ("evil" -> somewhere outside destRoot), and a later, lexically-safe entry
+// ("evil/passwd") would otherwise follow it straight out of destRoot.
+func TestSanitizeEntryPathRejectsPlantedSymlink(t *testing.T) {
+	destRoot := t.TempDir()
+	outside := t.TempDir()
+
+	evilLink := filepath.Join(destRoot, "evil")
+	if err := os.Symlink(outside, evilLink); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	if _, err := sanitizeEntryPath(destRoot, "evil/passwd"); err == nil {
+		t.Fatal("expected sanitizeEntryPath to reject a path with a planted symlink in its parents")
+	}
+}
+
+func TestSanitizeSymlinkTargetRejectsEscapes(t *testing.T) {
+	destRoot := t.TempDir()
+	destRootAbs, err := filepath.Abs(destRoot)
+	if err != nil {
+		t.Fatalf("Abs: %v", err)
+	}
+	fullPath := filepath.Join(destRootAbs, "link")
+
+	cases := []string{
+		"/etc/passwd",
+		"../outside",
+		"a/../../outside",
+	}
+	for _, target := range cases {
+		if err := sanitizeSymlinkTarget(destRootAbs, fullPath, target); err == nil {
+			t.Errorf("sanitizeSymlinkTarget(%q): expected an error, got nil", target)
+		}
+	}
+}
+
+func TestSanitizeSymlinkTargetAllowsWellBehavedTargets(t *testing.T) {
+	destRoot := t.TempDir()
+	destRootAbs, err := filepath.Abs(destRoot)
+	if err != nil {
+		t.Fatalf("Abs: %v", err)
+	}
+	fullPath := filepath.Join(destRootAbs, "sub", "link")
+
+	cases := []string{"sibling.txt", "../other.txt", filepath.Join(destRootAbs, "deep", "target.txt")}
+	for _, target := range cases {
+		if err := sanitizeSymlinkTarget(destRootAbs, fullPath, target); err != nil {
+			t.Errorf("sanitizeSymlinkTarget(%q): unexpected error: %v", target, err)
+		}
+	}
+}
+
+func TestSanitizeSymlinkTargetRejectsEmpty(t *testing.T) {
+	destRoot := t.TempDir()
+	destRootAbs, _ := filepath.Abs(destRoot)
+	if err := sanitizeSymlinkTarget(destRootAbs, filepath.Join(destRootAbs, "link"), ""); err == nil {
+		t.Fatal("expected sanitizeSymlinkTarget to reject an empty target")
+	}
+}
@@ -0,0 +1,122 @@
+// Package pairing derives a shared encryption key from a short, human-typable
+// code using a password-authenticated key exchange (PAKE). Two gshare
+// instances that know the same code end up with the same key without the
+// code (or the key) ever being sent over the wire, which is what lets
+// securechan trust the connection without also trusting the network it's
+// running over.
+package pairing
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/schollz/pake/v3"
+)
+
+// codeWords is deliberately small and all-lowercase so a code is easy to
+// read aloud and type on any keyboard.
+var codeWords = []string{
+	"anchor", "barrel", "cedar", "dune", "ember", "fable", "granite", "harbor",
+	"indigo", "juniper", "kernel", "lagoon", "marble", "nectar", "oasis", "pebble",
+	"quartz", "ridge", "sable", "thicket", "umber", "valley", "willow", "yonder",
+}
+
+// GenerateCode picks three random words, e.g. "harbor-dune-quartz". This is
+// the weak secret the PAKE exchange is built on, so the words are chosen
+// with crypto/rand rather than math/rand.
+func GenerateCode() string {
+	w := make([]string, 3)
+	for i := range w {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeWords))))
+		if err != nil {
+			panic(err)
+		}
+		w[i] = codeWords[n.Int64()]
+	}
+	return strings.Join(w, "-")
+}
+
+// PackCode folds the sender's address into a generated code, so the receiver
+// only has to be given the one string - not the code and a separately
+// tracked-down IP address - to both find and authenticate the sender.
+func PackCode(code, address string) string {
+	return code + "@" + address
+}
+
+// ParseCode splits a code produced by PackCode back into the PAKE secret and
+// the address to dial.
+func ParseCode(packed string) (code, address string, err error) {
+	code, address, ok := strings.Cut(packed, "@")
+	if !ok {
+		return "", "", errors.New("pairing: code is missing the \"@address\" part gshare's own codes always have")
+	}
+	return code, address, nil
+}
+
+// Exchange runs a SPAKE2 key exchange over conn, using code as the shared
+// weak secret, and returns the derived 32-byte session key. isSender picks
+// which of the two (otherwise symmetric) roles this end plays; the two ends
+// of a single exchange must pass opposite values.
+//
+// If the two sides were given different codes, this won't return an error
+// here - SPAKE2 always produces *a* shared secret, it just won't be the same
+// one on both ends. The mismatch only becomes apparent once securechan tries
+// to decrypt the first real message and fails.
+func Exchange(conn net.Conn, code string, isSender bool) ([]byte, error) {
+	role := 0
+	if !isSender {
+		role = 1
+	}
+
+	p, err := pake.InitCurve([]byte(code), role, "siec")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFrame(conn, p.Bytes()); err != nil {
+		return nil, err
+	}
+	theirBytes, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Update(theirBytes); err != nil {
+		return nil, err
+	}
+
+	secret, err := p.SessionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256(secret)
+	return key[:], nil
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	lengthBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthBytes, uint32(len(data)))
+	if _, err := w.Write(lengthBytes); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBytes); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(lengthBytes))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,132 @@
+// Package securechan wraps a net.Conn in an authenticated, encrypted stream.
+// Once two peers have a shared key (see the pairing package), everything
+// they exchange afterwards - filename, permissions, chunk count, file bytes,
+// all of it - is confidential and tamper-evident, framed as length-prefixed
+// AEAD records.
+package securechan
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Conn is a net.Conn that transparently encrypts what's written to it and
+// decrypts what's read from it. It's meant to be used as a drop-in
+// replacement for the underlying conn once the key has been agreed on.
+type Conn struct {
+	net.Conn
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+	key      []byte
+
+	sendCounter uint64
+	recvCounter uint64
+	recvBuffer  []byte
+}
+
+// New wraps conn with ChaCha20-Poly1305 AEADs keyed off key, which should be
+// the 32-byte output of pairing.Exchange. isSender must be the same value
+// passed to pairing.Exchange for this same connection, and must differ
+// between the two ends.
+//
+// Both ends derive the same key, and each would otherwise start its own
+// nonce counter at 0 - so the sender's first record and the receiver's first
+// record would both be sealed under (key, nonce=0), which breaks ChaCha20's
+// confidentiality the same way reusing an OTP does. Deriving separate
+// sender-write and receiver-write keys from key keeps each direction's
+// (key, nonce) pairs from ever colliding, even though both ends start their
+// own counters at 0.
+func New(conn net.Conn, key []byte, isSender bool) (*Conn, error) {
+	senderKey := directionKey(key, "sender")
+	receiverKey := directionKey(key, "receiver")
+
+	writeKey, readKey := receiverKey, senderKey
+	if isSender {
+		writeKey, readKey = senderKey, receiverKey
+	}
+
+	sendAEAD, err := chacha20poly1305.New(writeKey)
+	if err != nil {
+		return nil, err
+	}
+	recvAEAD, err := chacha20poly1305.New(readKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{Conn: conn, sendAEAD: sendAEAD, recvAEAD: recvAEAD, key: key}, nil
+}
+
+// directionKey derives a direction-specific AEAD key from key via HMAC, so
+// the sender-write and receiver-write keys are unrelated beyond both coming
+// from the same pairing secret.
+func directionKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Key returns the symmetric key this connection was set up with, so other
+// connections belonging to the same transfer (e.g. parallel data workers)
+// can prove they know it too without repeating the full pairing exchange.
+func (c *Conn) Key() []byte {
+	return c.key
+}
+
+// nonce builds a nonce out of a monotonically increasing counter, which is
+// enough to guarantee uniqueness as long as neither side sends more than
+// 2^64 records (it won't) - each direction has its own AEAD key, so the two
+// counters never need to be distinguished from each other.
+func nonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// Write seals p as a single AEAD record and sends it length-prefixed.
+func (c *Conn) Write(p []byte) (int, error) {
+	sealed := c.sendAEAD.Seal(nil, nonce(c.sendAEAD, c.sendCounter), p, nil)
+	c.sendCounter++
+
+	lengthBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthBytes, uint32(len(sealed)))
+	if _, err := c.Conn.Write(lengthBytes); err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(sealed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read fills p from the current decrypted record, reading and opening the
+// next one off the wire once the current one is exhausted.
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.recvBuffer) == 0 {
+		lengthBytes := make([]byte, 4)
+		if _, err := io.ReadFull(c.Conn, lengthBytes); err != nil {
+			return 0, err
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(lengthBytes))
+		if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+			return 0, err
+		}
+
+		plain, err := c.recvAEAD.Open(nil, nonce(c.recvAEAD, c.recvCounter), sealed, nil)
+		if err != nil {
+			return 0, err
+		}
+		c.recvCounter++
+		c.recvBuffer = plain
+	}
+
+	n := copy(p, c.recvBuffer)
+	c.recvBuffer = c.recvBuffer[n:]
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package securechan
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// pipeConns returns a connected pair of in-memory net.Conns, one per end.
+func pipeConns() (net.Conn, net.Conn) {
+	return net.Pipe()
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	senderRaw, receiverRaw := pipeConns()
+	defer senderRaw.Close()
+	defer receiverRaw.Close()
+
+	sender, err := New(senderRaw, key, true)
+	if err != nil {
+		t.Fatalf("New (sender): %v", err)
+	}
+	receiver, err := New(receiverRaw, key, false)
+	if err != nil {
+		t.Fatalf("New (receiver): %v", err)
+	}
+
+	message := []byte("hello over an encrypted pipe")
+	done := make(chan error, 1)
+	go func() {
+		_, err := sender.Write(message)
+		done <- err
+	}()
+
+	buf := make([]byte, len(message))
+	if _, err := receiver.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if !bytes.Equal(buf, message) {
+		t.Fatalf("got %q, want %q", buf, message)
+	}
+}
+
+// TestDirectionsUseDistinctKeys confirms the fix for the two-time-pad bug:
+// both ends derive the same shared key and both start their AEAD nonce
+// counter at 0, so if sender-write and receiver-write records were sealed
+// under the same key they'd be sealed under the same (key, nonce) pair too.
+// Distinct per-direction keys mean the two records are never interchangeable
+// ciphertext for the same nonce, even though the plaintexts and counters
+// line up exactly.
+func TestDirectionsUseDistinctKeys(t *testing.T) {
+	key := bytes.Repeat([]byte{0x7a}, 32)
+
+	senderRaw, receiverRaw := pipeConns()
+	defer senderRaw.Close()
+	defer receiverRaw.Close()
+
+	sender, err := New(senderRaw, key, true)
+	if err != nil {
+		t.Fatalf("New (sender): %v", err)
+	}
+	receiver, err := New(receiverRaw, key, false)
+	if err != nil {
+		t.Fatalf("New (receiver): %v", err)
+	}
+
+	plaintext := []byte("same plaintext, same counter, different key")
+
+	senderSealed := sender.sendAEAD.Seal(nil, nonce(sender.sendAEAD, 0), plaintext, nil)
+	receiverSealed := receiver.sendAEAD.Seal(nil, nonce(receiver.sendAEAD, 0), plaintext, nil)
+
+	if bytes.Equal(senderSealed, receiverSealed) {
+		t.Fatal("sender and receiver produced identical ciphertext for the same plaintext and nonce - directions are not using distinct keys")
+	}
+
+	// Each side must also be able to decrypt what the other direction sent.
+	if _, err := receiver.recvAEAD.Open(nil, nonce(receiver.recvAEAD, 0), senderSealed, nil); err != nil {
+		t.Fatalf("receiver could not open the sender's record: %v", err)
+	}
+	if _, err := sender.recvAEAD.Open(nil, nonce(sender.recvAEAD, 0), receiverSealed, nil); err != nil {
+		t.Fatalf("sender could not open the receiver's record: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+// Package session implements gshare's connection handshake: a 9P-style
+// version exchange so both ends agree on a protocol version, a maximum
+// message size, and which optional capabilities are available, before any
+// file data is sent.
+//
+// Wrapping this in a Session means new features (resume, multi-file,
+// encryption, ...) can check session.Supports(cap) instead of just assuming
+// the other end understands them, so older and newer clients can still talk
+// to each other.
+package session
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Magic is sent first so each side can tell quickly whether it's actually
+// talking to gshare and not, say, a stray HTTP client.
+const Magic = "GSHR"
+
+// ProtocolVersion is bumped whenever the handshake or framing changes in a
+// way older clients couldn't understand.
+const ProtocolVersion = "1"
+
+// defaultMaxMessageSize is what we propose during the handshake; the
+// negotiated value is the smaller of what each side proposes.
+const defaultMaxMessageSize = 1 << 20 // 1 MiB
+
+// DefaultChunkSize is what we propose as our transfer chunk size; like
+// MaxMessageSize, the negotiated value is the smaller of what each side
+// proposes, so a build with a bigger default can still talk to an older one.
+const DefaultChunkSize = 64 * 1024 // 64 KiB
+
+// DefaultParallelWorkers is how many extra data connections we propose
+// opening for a parallel transfer.
+const DefaultParallelWorkers = 4
+
+// Role distinguishes the two sides of the handshake. Right now both sides do
+// the same exchange, but keeping the role around leaves room for
+// role-specific behavior later.
+type Role int
+
+const (
+	RoleSender Role = iota
+	RoleReceiver
+)
+
+// Capability is a bitfield of optional protocol features. A capability is
+// only considered supported once both sides have advertised it.
+type Capability uint32
+
+const (
+	// CapResume means the rolling-hash delta resume dance (see the delta
+	// package) is understood.
+	CapResume Capability = 1 << iota
+	// CapParallel means the worker-pool chunked transfer (see the transfer
+	// file) is understood, so extra data connections can be opened.
+	CapParallel
+)
+
+// Session holds the outcome of a completed handshake.
+type Session struct {
+	conn           net.Conn
+	role           Role
+	Version        string
+	MaxMessageSize int
+	ChunkSize      int
+	ParallelWorkers int
+	capabilities   Capability
+}
+
+// NewSession performs the handshake over conn and returns the negotiated
+// Session. localCapabilities are the capabilities this build of gshare
+// understands; Supports will only report a capability as available once the
+// remote side has advertised it too.
+func NewSession(conn net.Conn, role Role, localCapabilities Capability) (*Session, error) {
+	out := make([]byte, 0, len(Magic) + 1 + len(ProtocolVersion) + 4 + 4 + 4 + 4)
+	out = append(out, []byte(Magic)...)
+	out = append(out, byte(len(ProtocolVersion)))
+	out = append(out, []byte(ProtocolVersion)...)
+	msizeBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(msizeBytes, uint32(defaultMaxMessageSize))
+	out = append(out, msizeBytes...)
+	capBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(capBytes, uint32(localCapabilities))
+	out = append(out, capBytes...)
+	chunkSizeBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunkSizeBytes, uint32(DefaultChunkSize))
+	out = append(out, chunkSizeBytes...)
+	workersBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(workersBytes, uint32(DefaultParallelWorkers))
+	out = append(out, workersBytes...)
+
+	if _, err := conn.Write(out); err != nil {
+		return nil, err
+	}
+
+	magicBuffer := make([]byte, len(Magic))
+	if _, err := io.ReadFull(conn, magicBuffer); err != nil {
+		return nil, err
+	}
+	if string(magicBuffer) != Magic {
+		return nil, fmt.Errorf("session: expected magic %q, got %q (are both sides running gshare?)", Magic, magicBuffer)
+	}
+
+	versionLenBuffer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, versionLenBuffer); err != nil {
+		return nil, err
+	}
+	versionBuffer := make([]byte, versionLenBuffer[0])
+	if _, err := io.ReadFull(conn, versionBuffer); err != nil {
+		return nil, err
+	}
+	remoteVersion := string(versionBuffer)
+	if remoteVersion != ProtocolVersion {
+		return nil, fmt.Errorf("session: we speak protocol version %q, the other side speaks %q", ProtocolVersion, remoteVersion)
+	}
+
+	remoteMsizeBuffer := make([]byte, 4)
+	if _, err := io.ReadFull(conn, remoteMsizeBuffer); err != nil {
+		return nil, err
+	}
+	remoteMsize := binary.BigEndian.Uint32(remoteMsizeBuffer)
+
+	remoteCapBuffer := make([]byte, 4)
+	if _, err := io.ReadFull(conn, remoteCapBuffer); err != nil {
+		return nil, err
+	}
+	remoteCapabilities := Capability(binary.BigEndian.Uint32(remoteCapBuffer))
+
+	remoteChunkSizeBuffer := make([]byte, 4)
+	if _, err := io.ReadFull(conn, remoteChunkSizeBuffer); err != nil {
+		return nil, err
+	}
+	remoteChunkSize := binary.BigEndian.Uint32(remoteChunkSizeBuffer)
+
+	remoteWorkersBuffer := make([]byte, 4)
+	if _, err := io.ReadFull(conn, remoteWorkersBuffer); err != nil {
+		return nil, err
+	}
+	remoteWorkers := binary.BigEndian.Uint32(remoteWorkersBuffer)
+
+	msize := defaultMaxMessageSize
+	if int(remoteMsize) < msize {
+		msize = int(remoteMsize)
+	}
+
+	chunkSize := DefaultChunkSize
+	if int(remoteChunkSize) < chunkSize {
+		chunkSize = int(remoteChunkSize)
+	}
+
+	workers := DefaultParallelWorkers
+	if int(remoteWorkers) < workers {
+		workers = int(remoteWorkers)
+	}
+
+	return &Session{
+		conn:            conn,
+		role:            role,
+		Version:         ProtocolVersion,
+		MaxMessageSize:  msize,
+		ChunkSize:       chunkSize,
+		ParallelWorkers: workers,
+		capabilities:    localCapabilities & remoteCapabilities,
+	}, nil
+}
+
+// Supports reports whether both sides of this session advertised cap.
+func (s *Session) Supports(cap Capability) bool {
+	return s.capabilities&cap != 0
+}
+
+// Conn returns the underlying connection, for code that hasn't been taught
+// to go through Session yet.
+func (s *Session) Conn() net.Conn {
+	return s.conn
+}
+
+// Role returns which side of the handshake this session was created as.
+func (s *Session) Role() Role {
+	return s.role
+}
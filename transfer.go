@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gshare/delta"
+	"gshare/securechan"
+)
+
+// workerNonceSize is the length of the random per-connection nonce a worker
+// mixes into its channel key (see workerChannelKey).
+const workerNonceSize = 16
+
+// Parallel chunked transfer spreads one file's chunks across a pool of
+// worker connections instead of the single control connection, so the
+// transfer isn't capped by one TCP connection's latency/window.
+//
+// It kicks in for a fresh send of a file with more chunks than workers. A
+// resumed transfer with more literal (unmatched) spans than workers also uses the
+// worker pool: the instruction stream itself - which block to copy from the
+// old file versus which bytes are actually missing - stays on the single
+// control connection, but the missing bytes are the only thing pulled
+// across the worker pool; see sendLiteralsParallel/receiveLiteralsParallel.
+
+// workerAuthToken proves a data connection belongs to the same transfer as
+// the already-paired control connection, without repeating the full PAKE
+// exchange: it's an HMAC over the transfer ID keyed by the control
+// connection's session key.
+func workerAuthToken(key []byte, transferID uint64) []byte {
+	idBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(idBytes, transferID)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(idBytes)
+	return mac.Sum(nil)
+}
+
+// workerChannelKey derives a connection-specific AEAD key from the session
+// key, transferID, and a nonce unique to this one worker connection. Every
+// worker for a transfer would otherwise seal records under the same
+// securechan key with nonce counters that each start at 0, which is nonce
+// reuse under ChaCha20-Poly1305; mixing in a per-connection nonce keeps each
+// worker's key distinct even though they all derive from the same secret.
+func workerChannelKey(key []byte, transferID uint64, connNonce []byte) []byte {
+	idBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(idBytes, transferID)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(idBytes)
+	mac.Write(connNonce)
+	return mac.Sum(nil)
+}
+
+// acceptWorkers accepts connections on ln until n of them present a valid
+// token for transferID, discarding the rest, and wraps each in its own
+// securechan.Conn so chunk bytes aren't carried in the clear.
+func acceptWorkers(ln net.Listener, key []byte, transferID uint64, n int) ([]net.Conn, error) {
+	want := workerAuthToken(key, transferID)
+	workers := make([]net.Conn, 0, n)
+	for len(workers) < n {
+		conn, err := ln.Accept()
+		if err != nil {
+			closeAll(workers)
+			return nil, err
+		}
+
+		got := make([]byte, len(want)+workerNonceSize)
+		if _, err := io.ReadFull(conn, got); err != nil || !hmac.Equal(got[:len(want)], want) {
+			conn.Close()
+			continue
+		}
+		connNonce := got[len(want):]
+
+		secureConn, err := securechan.New(conn, workerChannelKey(key, transferID, connNonce), true)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+
+		workers = append(workers, secureConn)
+	}
+	return workers, nil
+}
+
+// dialWorkers opens n data connections to address, proves knowledge of key
+// on each, and wraps each in its own securechan.Conn so chunk bytes aren't
+// carried in the clear.
+func dialWorkers(address string, key []byte, transferID uint64, n int) ([]net.Conn, error) {
+	token := workerAuthToken(key, transferID)
+	workers := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", address+":"+PORT)
+		if err != nil {
+			closeAll(workers)
+			return nil, err
+		}
+
+		connNonce := make([]byte, workerNonceSize)
+		if _, err := rand.Read(connNonce); err != nil {
+			conn.Close()
+			closeAll(workers)
+			return nil, err
+		}
+
+		if _, err := conn.Write(append(token, connNonce...)); err != nil {
+			conn.Close()
+			closeAll(workers)
+			return nil, err
+		}
+
+		secureConn, err := securechan.New(conn, workerChannelKey(key, transferID, connNonce), false)
+		if err != nil {
+			conn.Close()
+			closeAll(workers)
+			return nil, err
+		}
+
+		workers = append(workers, secureConn)
+	}
+	return workers, nil
+}
+
+// closeAll closes every connection in conns, ignoring errors; used for
+// cleanup both on a worker pool's failure path and once a transfer is done.
+func closeAll(conns []net.Conn) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// writeChunkFrame and readChunkFrame frame a single out-of-order chunk as
+// its index, its length, and then the bytes themselves.
+func writeChunkFrame(w io.Writer, index int64, data []byte) error {
+	header := make([]byte, 8+4)
+	binary.BigEndian.PutUint64(header[0:8], uint64(index))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readChunkFrame reads a frame written by writeChunkFrame. maxLen caps how
+// large the frame's length field is allowed to claim, so a corrupted or
+// hostile frame can't force an unbounded allocation before we even know
+// whether that many bytes actually follow.
+func readChunkFrame(r io.Reader, maxLen uint32) (int64, []byte, error) {
+	header := make([]byte, 8+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	index := int64(binary.BigEndian.Uint64(header[0:8]))
+	length := binary.BigEndian.Uint32(header[8:12])
+	if length > maxLen {
+		return 0, nil, fmt.Errorf("transfer: chunk frame claims %d bytes, more than the negotiated %d-byte max message size", length, maxLen)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return index, data, nil
+}
+
+// sendChunksParallel reads chunkSize-d chunks of file and hands them out to
+// workers on a pull basis: whichever worker finishes first claims the next
+// chunk index, so a slow connection just ends up carrying less of the file
+// instead of stalling the fast ones.
+func sendChunksParallel(workers []net.Conn, file *os.File, chunkSize, chunkCount int64, fileIndex, fileTotal int, taskName, successMessage string) error {
+	var nextChunk int64
+	var completed int64
+
+	startTime := time.Now()
+	timeOfLastProgressBarUpdate := time.Unix(0, 0)
+	var progressMu sync.Mutex
+	hideCursor()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(workers))
+
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(worker net.Conn) {
+			defer wg.Done()
+			buf := make([]byte, chunkSize)
+			for {
+				chunkIndex := atomic.AddInt64(&nextChunk, 1) - 1
+				if chunkIndex >= chunkCount {
+					return
+				}
+
+				n, err := file.ReadAt(buf, chunkIndex*chunkSize)
+				if err != nil && err != io.EOF {
+					errs <- err
+					return
+				}
+				if err := writeChunkFrame(worker, chunkIndex, buf[:n]); err != nil {
+					errs <- err
+					return
+				}
+
+				done := atomic.AddInt64(&completed, 1)
+				progressMu.Lock()
+				UpdateNestedProgressBar(int(done), int(chunkCount), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, taskName, successMessage)
+				progressMu.Unlock()
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+	showCursor()
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveChunksParallel is the receiving half of sendChunksParallel: each
+// worker reads whatever chunks land on its connection and writes them
+// straight to their place in f (chunkIndex * chunkSize), regardless of the
+// order they arrive in.
+func receiveChunksParallel(workers []net.Conn, f *os.File, chunkSize, chunkCount int64, fileIndex, fileTotal int, taskName, successMessage string) error {
+	var completed int64
+
+	startTime := time.Now()
+	timeOfLastProgressBarUpdate := time.Unix(0, 0)
+	var progressMu sync.Mutex
+	hideCursor()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(workers))
+
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(worker net.Conn) {
+			defer wg.Done()
+			for {
+				index, data, err := readChunkFrame(worker, uint32(chunkSize))
+				if err != nil {
+					if err == io.EOF {
+						return
+					}
+					errs <- err
+					return
+				}
+
+				if _, err := f.WriteAt(data, index*chunkSize); err != nil {
+					errs <- err
+					return
+				}
+
+				done := atomic.AddInt64(&completed, 1)
+				progressMu.Lock()
+				UpdateNestedProgressBar(int(done), int(chunkCount), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, taskName, successMessage)
+				progressMu.Unlock()
+
+				if done >= chunkCount {
+					return
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+	showCursor()
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// literalJob is one span of source bytes a resumed transfer's delta couldn't
+// match against the receiver's old file, so it has to cross the wire. Unlike
+// a plain chunked transfer, spans aren't a uniform size - they're whatever
+// ComputeDelta's literal runs happened to be.
+type literalJob struct {
+	Offset int64
+	Length int64
+}
+
+// literalJobs pulls the literal spans out of a delta instruction stream, in
+// the order sendLiteralsParallel/receiveLiteralsParallel will exchange them.
+func literalJobs(instructions []delta.Instruction) []literalJob {
+	var jobs []literalJob
+	for _, inst := range instructions {
+		if inst.Op == delta.OpLiteral {
+			jobs = append(jobs, literalJob{Offset: inst.Offset, Length: int64(len(inst.Data))})
+		}
+	}
+	return jobs
+}
+
+// sendLiteralsParallel reads each job's bytes from file at its Offset and
+// hands it to whichever worker pulls it next, tagged with that Offset so the
+// receiver can place it regardless of arrival order.
+func sendLiteralsParallel(workers []net.Conn, file *os.File, jobs []literalJob, fileIndex, fileTotal int, taskName, successMessage string) error {
+	var next int64
+	var completed int64
+	total := int64(len(jobs))
+
+	startTime := time.Now()
+	timeOfLastProgressBarUpdate := time.Unix(0, 0)
+	var progressMu sync.Mutex
+	hideCursor()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(workers))
+
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(worker net.Conn) {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1) - 1
+				if i >= total {
+					return
+				}
+				job := jobs[i]
+
+				buf := make([]byte, job.Length)
+				if _, err := file.ReadAt(buf, job.Offset); err != nil && err != io.EOF {
+					errs <- err
+					return
+				}
+				if err := writeChunkFrame(worker, job.Offset, buf); err != nil {
+					errs <- err
+					return
+				}
+
+				done := atomic.AddInt64(&completed, 1)
+				progressMu.Lock()
+				UpdateNestedProgressBar(int(done), int(total), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, taskName, successMessage)
+				progressMu.Unlock()
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+	showCursor()
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveLiteralsParallel is the receiving half of sendLiteralsParallel: each
+// worker reads whatever literal spans land on its connection and writes them
+// straight to their offset in f, regardless of arrival order, until total
+// spans have been placed. maxLen caps how large a single span's frame is
+// allowed to claim to be.
+func receiveLiteralsParallel(workers []net.Conn, f *os.File, total int64, maxLen uint32, fileIndex, fileTotal int, taskName, successMessage string) error {
+	var completed int64
+
+	startTime := time.Now()
+	timeOfLastProgressBarUpdate := time.Unix(0, 0)
+	var progressMu sync.Mutex
+	hideCursor()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(workers))
+
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(worker net.Conn) {
+			defer wg.Done()
+			for {
+				offset, data, err := readChunkFrame(worker, maxLen)
+				if err != nil {
+					if err == io.EOF {
+						return
+					}
+					errs <- err
+					return
+				}
+
+				if _, err := f.WriteAt(data, offset); err != nil {
+					errs <- err
+					return
+				}
+
+				done := atomic.AddInt64(&completed, 1)
+				progressMu.Lock()
+				UpdateNestedProgressBar(int(done), int(total), fileIndex, fileTotal, startTime, timeOfLastProgressBarUpdate, taskName, successMessage)
+				progressMu.Unlock()
+
+				if done >= total {
+					return
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+	showCursor()
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}